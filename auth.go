@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/oauth2"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promDescAuthTokenExpiry = prometheus.NewDesc(
+		namespace+"_auth_token_expiry_seconds",
+		"Unix timestamp at which the current OAuth2 access token expires.",
+		[]string{"server", "user"}, nil)
+	promAuthRefreshTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_refresh_total",
+		Help:      "Number of OAuth2 access token refresh attempts, by result.",
+	}, []string{"server", "user", "result"})
+)
+
+// tokenCache wraps an oauth2.TokenSource so the same refreshed access token
+// is reused across scrapes instead of being refetched on every connection,
+// only refreshing once the cached token is within TokenSkew of expiring.
+type tokenCache struct {
+	source oauth2.TokenSource
+	skew   time.Duration
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func newTokenCache(auth AuthConfig) *tokenCache {
+	conf := &oauth2.Config{
+		ClientID:     auth.ClientID,
+		ClientSecret: auth.ClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: auth.TokenURL},
+	}
+	return &tokenCache{
+		source: conf.TokenSource(context.Background(), &oauth2.Token{RefreshToken: auth.RefreshToken}),
+		skew:   auth.TokenSkew,
+	}
+}
+
+func (t *tokenCache) accessToken(host, user string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != nil && !t.token.Expiry.IsZero() && time.Until(t.token.Expiry) > t.skew {
+		return t.token.AccessToken, nil
+	}
+
+	token, err := t.source.Token()
+	if err != nil {
+		promAuthRefreshTotal.WithLabelValues(host, user, "failure").Inc()
+		return "", fmt.Errorf("cannot refresh OAuth2 token: %s", err)
+	}
+	t.token = token
+	promAuthRefreshTotal.WithLabelValues(host, user, "success").Inc()
+	return token.AccessToken, nil
+}
+
+func (t *tokenCache) expirySeconds() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token == nil || t.token.Expiry.IsZero() {
+		return 0
+	}
+	return float64(t.token.Expiry.Unix())
+}
+
+// authenticate logs into c using account's configured auth mode: plain
+// LOGIN, or XOAUTH2/OAUTHBEARER over SASL for providers that have disabled
+// password auth.
+func authenticate(c *client.Client, account Account, host string) error {
+	user := account.URL.User.Username()
+
+	switch account.Auth.Mode {
+	case "", "plain":
+		password, _ := account.URL.User.Password()
+		return c.Login(user, password)
+
+	case "xoauth2":
+		token, err := account.TokenCache.accessToken(host, user)
+		if err != nil {
+			return err
+		}
+		return c.Authenticate(sasl.NewXoauth2Client(user, token))
+
+	case "oauthbearer":
+		token, err := account.TokenCache.accessToken(host, user)
+		if err != nil {
+			return err
+		}
+		return c.Authenticate(sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: user,
+			Token:    token,
+		}))
+
+	default:
+		return fmt.Errorf("unknown auth mode: %s", account.Auth.Mode)
+	}
+}
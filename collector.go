@@ -30,6 +30,10 @@ var (
 		namespace+"_unread_total",
 		"Number of unread messages",
 		[]string{"server", "user", "mailbox"}, nil)
+	promDescImapMessagesQueryCount = prometheus.NewDesc(
+		namespace+"_query_count",
+		"Number of messages matching a named search query",
+		[]string{"server", "user", "mailbox", "query"}, nil)
 )
 
 type imapDialer interface {
@@ -46,17 +50,34 @@ type imapDialerTLS struct {
 	tlsConfig *tls.Config
 }
 
+// imapDialerStartTLS dials in plaintext on the regular IMAP port, then
+// upgrades the connection with STARTTLS before any credentials are sent. It
+// refuses to proceed if the server does not advertise the capability or if
+// the upgrade fails.
+type imapDialerStartTLS struct {
+	imapDialerPlainText
+	tlsConfig *tls.Config
+}
+
 type imapMetrics struct {
-	timeout              time.Duration
-	dialer               imapDialer
-	host, user, password string
-	filter               string
-	promCounterOk        prometheus.Counter
+	timeout       time.Duration
+	dialer        imapDialer
+	account       Account
+	host, user    string
+	filter        string
+	queries       []Query
+	promCounterOk prometheus.Counter
+
+	// pool is the account's persistent connection, if any. When it is up,
+	// collect() reuses it (and any IDLE-cached counts) instead of dialing a
+	// fresh connection for every scrape.
+	pool *connection
 }
 
 type Collector struct {
-	imapMetrics []*imapMetrics
-	promCounter *prometheus.CounterVec
+	imapMetrics      []*imapMetrics
+	roundTripMetrics []*roundTripMetrics
+	promCounter      *prometheus.CounterVec
 }
 
 func errorToPromResult(err error) float64 {
@@ -73,11 +94,30 @@ func errorToString(err error) string {
 	return "ko"
 }
 
+func boolToPromResult(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	c.promCounter.Describe(ch)
 	ch <- promDescImapMessagesServerOkDesc
 	ch <- promDescImapMessagesTotalCount
 	ch <- promDescImapMessagesUnreadCount
+	ch <- promDescImapMessagesQueryCount
+	ch <- promDescConnectionUp
+	promReconnectsTotal.Describe(ch)
+	promIdleEventsTotal.Describe(ch)
+	ch <- promDescAuthTokenExpiry
+	promAuthRefreshTotal.Describe(ch)
+	if len(c.roundTripMetrics) > 0 {
+		promRoundTripDuration.Describe(ch)
+		ch <- promDescRoundTripSuccess
+		ch <- promDescRoundTripLastDelivery
+		promRoundTripFailures.Describe(ch)
+	}
 }
 
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
@@ -90,6 +130,18 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 				errorToPromResult(err),
 				metric.host, metric.user)
 
+			if metric.pool != nil {
+				ch <- prometheus.MustNewConstMetric(promDescConnectionUp, prometheus.GaugeValue,
+					boolToPromResult(metric.pool.isUp()),
+					metric.host, metric.user)
+			}
+
+			if metric.account.TokenCache != nil {
+				ch <- prometheus.MustNewConstMetric(promDescAuthTokenExpiry, prometheus.GaugeValue,
+					metric.account.TokenCache.expirySeconds(),
+					metric.host, metric.user)
+			}
+
 			res := c.promCounter.WithLabelValues(metric.host, errorToString(err))
 			res.Inc()
 			res.Collect(ch)
@@ -97,24 +149,61 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 			errors <- err
 		}(metric)
 	}
+	for _, probe := range c.roundTripMetrics {
+		go func(probe *roundTripMetrics) {
+			errors <- probe.collect(ch)
+		}(probe)
+	}
 	for range c.imapMetrics {
 		if err := <-errors; err != nil {
 			log.Println(err)
 		}
 	}
+	for range c.roundTripMetrics {
+		if err := <-errors; err != nil {
+			log.Println(err)
+		}
+	}
+
+	promReconnectsTotal.Collect(ch)
+	promIdleEventsTotal.Collect(ch)
+	promAuthRefreshTotal.Collect(ch)
+	promRoundTripDuration.Collect(ch)
+	promRoundTripFailures.Collect(ch)
 }
 
 func (i *imapMetrics) collect(ch chan<- prometheus.Metric) error {
+	if i.pool != nil {
+		if c, up := i.pool.getClient(); up && c != nil {
+			i.pool.cmdMu.Lock()
+			err := i.listAndCollect(c, ch)
+			i.pool.cmdMu.Unlock()
+			if err == nil {
+				return nil
+			}
+			log.Printf("Pooled connection to %s failed (%s), reconnecting", i.host, err)
+			i.pool.markDown()
+		}
+	}
+
 	c, err := i.dialer.dial()
 	if err != nil {
 		return fmt.Errorf("Error while dialing %s: %s", i.host, err)
 	}
-	defer i.disconnect(c)
+	defer disconnectClient(c)
 
-	if err := c.Login(i.user, i.password); err != nil {
+	if err := authenticate(c, i.account, i.host); err != nil {
 		return fmt.Errorf("Error while logging into %s: %s", i.host, err)
 	}
 
+	return i.listAndCollect(c, ch)
+}
+
+// listAndCollect lists the account's matching mailboxes and publishes their
+// total/unread counts (from the IDLE cache when available, STATUS otherwise),
+// plus the configured custom queries. It issues no dial/login/logout of its
+// own so it can run equally over a pooled or a freshly dialed connection.
+func (i *imapMetrics) listAndCollect(c *client.Client, ch chan<- prometheus.Metric) error {
 	mailboxes := make(chan *imap.MailboxInfo)
 	done := make(chan error)
 	go func() {
@@ -129,26 +218,77 @@ func (i *imapMetrics) collect(ch chan<- prometheus.Metric) error {
 		return fmt.Errorf("Error while fetching the mailboxes on %s: %s", i.host, err)
 	}
 
+	var err error
 	for _, m := range mailboxesList {
-		mbox, err := c.Status(m.Name, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
-		if err != nil {
-			err = fmt.Errorf("Error while fetching mailbox %s on %s: %s", mbox.Name, i.host, err)
+		messages, unseen, cached := i.cachedCount(m.Name)
+		if !cached {
+			mbox, statusErr := c.Status(m.Name, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+			if statusErr != nil {
+				err = fmt.Errorf("Error while fetching mailbox %s on %s: %s", m.Name, i.host, statusErr)
+				continue
+			}
+			messages, unseen = uint32(mbox.Messages), uint32(mbox.Unseen)
 		}
+
 		ch <- prometheus.MustNewConstMetric(promDescImapMessagesTotalCount, prometheus.GaugeValue,
-			float64(mbox.Messages),
+			float64(messages),
 			i.host, i.user, m.Name)
 		ch <- prometheus.MustNewConstMetric(promDescImapMessagesUnreadCount, prometheus.GaugeValue,
-			float64(mbox.Unseen),
+			float64(unseen),
 			i.host, i.user, m.Name)
 	}
+
+	for _, query := range i.queries {
+		if _, selectErr := c.Select(query.Mailbox, true); selectErr != nil {
+			err = fmt.Errorf("Error while selecting mailbox %s on %s: %s", query.Mailbox, i.host, selectErr)
+			continue
+		}
+
+		uids, searchErr := c.Search(buildSearchCriteria(query.Criteria))
+		if searchErr != nil {
+			err = fmt.Errorf("Error while running query %s on %s: %s", query.Name, i.host, searchErr)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(promDescImapMessagesQueryCount, prometheus.GaugeValue,
+			float64(len(uids)),
+			i.host, i.user, query.Mailbox, query.Name)
+	}
 	return err
 }
 
-func (i *imapMetrics) disconnect(client *client.Client) {
-	if err := client.Logout(); err != nil {
+// cachedCount reads a mailbox's counts from the account's IDLE cache, if the
+// account is pooled and IDLE has populated one for that mailbox yet.
+func (i *imapMetrics) cachedCount(mailbox string) (messages, unseen uint32, ok bool) {
+	if i.pool == nil {
+		return 0, 0, false
+	}
+	return i.pool.cachedCount(mailbox)
+}
+
+func disconnectClient(c *client.Client) {
+	if err := c.Logout(); err != nil {
 		log.Println("Could not logout:", err)
 	}
-	client.Terminate()
+	c.Terminate()
+}
+
+// dialAccount dials and logs into an Account's URL. It is used by the
+// persistent connection pool, its IDLE watchers and the round-trip probes;
+// imapMetrics.collect (and so /probe) dials through its own imapDialer.
+func dialAccount(account Account, timeout time.Duration) (*client.Client, error) {
+	dialer := newDialer(account.URL.Scheme, account.URL.Host, timeout, account.TLSConfig)
+	c, err := dialer.dial()
+	if err != nil {
+		return nil, fmt.Errorf("error while dialing %s: %s", account.URL.Host, err)
+	}
+
+	host, _, _ := net.SplitHostPort(account.URL.Host)
+	if err := authenticate(c, account, host); err != nil {
+		disconnectClient(c)
+		return nil, fmt.Errorf("error while logging into %s: %s", account.URL.Host, err)
+	}
+	return c, nil
 }
 
 func (i *imapDialerPlainText) dial() (*client.Client, error) {
@@ -165,6 +305,44 @@ func (i *imapDialerTLS) dial() (*client.Client, error) {
 	return client.DialWithDialerTLS(&dialer, i.hostport, i.tlsConfig)
 }
 
+func (i *imapDialerStartTLS) dial() (*client.Client, error) {
+	dialer := net.Dialer{
+		Timeout: i.timeout,
+	}
+	c, err := client.DialWithDialer(&dialer, i.hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := c.Support("STARTTLS")
+	if err != nil {
+		c.Terminate()
+		return nil, fmt.Errorf("could not check STARTTLS capability on %s: %s", i.hostport, err)
+	}
+	if !ok {
+		c.Terminate()
+		return nil, fmt.Errorf("%s does not advertise the STARTTLS capability", i.hostport)
+	}
+	if err := c.StartTLS(i.tlsConfig); err != nil {
+		c.Terminate()
+		return nil, fmt.Errorf("STARTTLS failed on %s: %s", i.hostport, err)
+	}
+	return c, nil
+}
+
+// newDialer picks the imapDialer matching the account/probe URL scheme.
+func newDialer(scheme, hostport string, timeout time.Duration, tlsConfig *tls.Config) imapDialer {
+	plainText := imapDialerPlainText{hostport: hostport, timeout: timeout}
+	switch scheme {
+	case "imaps":
+		return &imapDialerTLS{imapDialerPlainText: plainText, tlsConfig: tlsConfig}
+	case "imap+starttls":
+		return &imapDialerStartTLS{imapDialerPlainText: plainText, tlsConfig: tlsConfig}
+	default:
+		return &plainText
+	}
+}
+
 func NewCollector(config *Config, client *http.Client) Collector {
 	collector := Collector{
 		promCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -179,33 +357,33 @@ func NewCollector(config *Config, client *http.Client) Collector {
 		if err != nil {
 			log.Fatalf("Could not split host/port: %s", err)
 		}
-		password, _ := account.URL.User.Password()
-
-		var dialer imapDialer
-		if account.URL.Scheme == "imaps" {
-			dialer = &imapDialerTLS{
-				imapDialerPlainText: imapDialerPlainText{
-					hostport: account.URL.Host,
-					timeout:  config.Timeout,
-				},
-				tlsConfig: account.TLSConfig,
-			}
-		} else {
-			dialer = &imapDialerPlainText{
-				hostport: account.URL.Host,
-				timeout:  config.Timeout,
-			}
-		}
+
+		dialer := newDialer(account.URL.Scheme, account.URL.Host, config.Timeout, account.TLSConfig)
+		user := account.URL.User.Username()
+
+		pool := newConnection(account, config.Timeout, host, user)
+		go pool.run()
 
 		collector.imapMetrics = append(collector.imapMetrics, &imapMetrics{
-			filter:   account.Filter,
-			timeout:  config.Timeout,
-			dialer:   dialer,
-			host:     host,
-			user:     account.URL.User.Username(),
-			password: password,
+			filter:  account.Filter,
+			timeout: config.Timeout,
+			dialer:  dialer,
+			account: account,
+			host:    host,
+			user:    user,
+			queries: account.Queries,
+			pool:    pool,
 		})
 	}
 
+	for _, probe := range config.Probes {
+		roundTrip, err := newRoundTripMetrics(probe, config.Timeout)
+		if err != nil {
+			log.Fatalf("Could not set up round-trip probe %s: %s", probe.Name, err)
+		}
+		go roundTrip.run()
+		collector.roundTripMetrics = append(collector.roundTripMetrics, roundTrip)
+	}
+
 	return collector
 }
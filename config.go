@@ -4,36 +4,325 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net/textproto"
 	"net/url"
 	"os"
 	"strings"
 	"time"
+
+	"github.com/emersion/go-imap"
 )
 
 type Account struct {
 	Filter    string
 	TLSConfig *tls.Config
 	URL       *url.URL
+	Queries   []Query
+	// Idle asks the collector to keep a persistent IDLE connection open per
+	// matching mailbox instead of polling with STATUS on every scrape.
+	Idle bool
+	Auth AuthConfig
+	// TokenCache is non-nil only when Auth.Mode requires OAuth2; it survives
+	// across scrapes so a refreshed token is reused instead of refetched.
+	TokenCache *tokenCache
+}
+
+// AuthConfig selects how an account authenticates: the classic LOGIN
+// command, or SASL XOAUTH2/OAUTHBEARER for providers (Gmail, Office 365)
+// that have disabled password auth.
+type AuthConfig struct {
+	Mode         string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	TokenURL     string
+	TokenSkew    time.Duration
+}
+
+// Query is a named, account-scoped IMAP search used to publish
+// imap_messages_query_count{server,user,mailbox,query} in addition to the
+// regular total/unread counts. Criteria is kept in its JSON-friendly form
+// rather than as a *imap.SearchCriteria so that relative bounds (SinceDays)
+// are computed fresh on every scrape instead of once at startup.
+type Query struct {
+	Name     string
+	Mailbox  string
+	Criteria QueryCriteria
+}
+
+type QueryCriteria struct {
+	From, To, Subject string
+	Body, Text        string
+	SinceDays         int
+	Unseen, Seen      bool
+	Flagged           bool
+	Larger, Smaller   uint32
+}
+
+// ModuleConfig describes a named probe configuration, analogous to the
+// Prometheus blackbox exporter's modules: it carries everything needed to
+// collect metrics from a target supplied at scrape time by /probe.
+type ModuleConfig struct {
+	Filter    string
+	Timeout   time.Duration
+	TLSConfig *tls.Config
+	Queries   []Query
+	Auth      AuthConfig
+	// TokenCache is non-nil only when Auth.Mode requires OAuth2.
+	TokenCache *tokenCache
+}
+
+// RoundTripProbe describes an active mail-flow check: a message is injected
+// over SMTP and the exporter polls the IMAP mailbox until it is delivered (or
+// a deadline elapses), measuring the end-to-end latency. It runs on its own
+// Interval rather than on every scrape, so Collect only ever reads a cached
+// result.
+type RoundTripProbe struct {
+	Name         string
+	Account      Account
+	Mailbox      string
+	SMTPHost     string
+	SMTPFrom     string
+	SMTPTo       string
+	Deadline     time.Duration
+	PollInterval time.Duration
+	Interval     time.Duration
 }
 
 type Config struct {
 	Listen   string
 	Timeout  time.Duration
 	Accounts []Account
+	Modules  map[string]ModuleConfig
+	Probes   []RoundTripProbe
 }
 
 type internalAccount struct {
-	Filter            string `json:"filter"`
-	SkipTLSValidation bool   `json:"skip_tls_validation"`
-	Pem               string `json:"pem"`
-	URL               string `json:"url"`
+	Filter            string          `json:"filter"`
+	SkipTLSValidation bool            `json:"skip_tls_validation"`
+	Pem               string          `json:"pem"`
+	URL               string          `json:"url"`
+	Queries           []internalQuery `json:"queries"`
+	Idle              bool            `json:"idle"`
+	Auth              string          `json:"auth"`
+	ClientID          string          `json:"client_id"`
+	ClientSecret      string          `json:"client_secret"`
+	RefreshToken      string          `json:"refresh_token"`
+	TokenURL          string          `json:"token_url"`
+	TokenSkewSeconds  float64         `json:"token_skew"`
+}
+
+type internalSearchCriteria struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	Text      string `json:"text"`
+	SinceDays int    `json:"since_days"`
+	Unseen    bool   `json:"unseen"`
+	Seen      bool   `json:"seen"`
+	Flagged   bool   `json:"flagged"`
+	Larger    uint32 `json:"larger"`
+	Smaller   uint32 `json:"smaller"`
+}
+
+type internalQuery struct {
+	Name     string                 `json:"name"`
+	Mailbox  string                 `json:"mailbox"`
+	Criteria internalSearchCriteria `json:"criteria"`
+}
+
+type internalModule struct {
+	Filter            string          `json:"filter"`
+	TimeoutSeconds    float64         `json:"timeout"`
+	SkipTLSValidation bool            `json:"skip_tls_validation"`
+	Pem               string          `json:"pem"`
+	Queries           []internalQuery `json:"queries"`
+	Auth              string          `json:"auth"`
+	ClientID          string          `json:"client_id"`
+	ClientSecret      string          `json:"client_secret"`
+	RefreshToken      string          `json:"refresh_token"`
+	TokenURL          string          `json:"token_url"`
+	TokenSkewSeconds  float64         `json:"token_skew"`
+}
+
+type internalProbe struct {
+	Name                string  `json:"name"`
+	URL                 string  `json:"url"`
+	SkipTLSValidation   bool    `json:"skip_tls_validation"`
+	Pem                 string  `json:"pem"`
+	Mailbox             string  `json:"mailbox"`
+	SMTPHost            string  `json:"smtp_host"`
+	SMTPFrom            string  `json:"smtp_from"`
+	SMTPTo              string  `json:"smtp_to"`
+	DeadlineSeconds     float64 `json:"deadline"`
+	PollIntervalSeconds float64 `json:"poll_interval"`
+	IntervalSeconds     float64 `json:"interval"`
 }
 
 type internalConfig struct {
-	Listen         string            `json:"listen"`
-	TimeoutSeconds float64           `json:"timeout"`
-	Accounts       []internalAccount `json:"accounts"`
+	Listen         string                    `json:"listen"`
+	TimeoutSeconds float64                   `json:"timeout"`
+	Accounts       []internalAccount         `json:"accounts"`
+	Modules        map[string]internalModule `json:"modules"`
+	Probes         []internalProbe           `json:"probes"`
+}
+
+// buildTLSConfig turns the skip_tls_validation/pem pair shared by accounts
+// and modules into a *tls.Config, or nil if neither is set.
+func buildTLSConfig(skipTLSValidation bool, pem string) *tls.Config {
+	if !skipTLSValidation && pem == "" {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if skipTLSValidation {
+		tlsConfig.InsecureSkipVerify = true
+	} else if pem != "" {
+		roots := x509.NewCertPool()
+		if ok := roots.AppendCertsFromPEM([]byte(pem)); !ok {
+			log.Fatalf("failed to parse root certificate %s", pem)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return tlsConfig
+}
+
+// buildAuthConfig turns the auth fields shared by accounts and modules into
+// an AuthConfig, defaulting Mode to "plain" and TokenSkew to one minute, and
+// preparing a tokenCache for the OAuth2 modes.
+func buildAuthConfig(mode, clientID, clientSecret, refreshToken, tokenURL string, tokenSkewSeconds float64, target string) (AuthConfig, *tokenCache) {
+	auth := AuthConfig{
+		Mode:         mode,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RefreshToken: refreshToken,
+		TokenURL:     tokenURL,
+		TokenSkew:    time.Duration(tokenSkewSeconds * float64(time.Second)),
+	}
+	if auth.Mode == "" {
+		auth.Mode = "plain"
+	}
+	if auth.TokenSkew == 0 {
+		auth.TokenSkew = time.Minute
+	}
+
+	var tokenCache *tokenCache
+	switch auth.Mode {
+	case "plain":
+		// Nothing to prepare: c.Login uses the target URL's credentials.
+	case "xoauth2", "oauthbearer":
+		tokenCache = newTokenCache(auth)
+	default:
+		log.Fatalf("Unknown auth mode for %s: %s", target, auth.Mode)
+	}
+	return auth, tokenCache
+}
+
+// buildQueries converts a config's JSON-friendly queries into Query values,
+// defaulting Mailbox to INBOX.
+func buildQueries(internalQueries []internalQuery) []Query {
+	var queries []Query
+	for _, internalQuery := range internalQueries {
+		query := Query{
+			Name:    internalQuery.Name,
+			Mailbox: internalQuery.Mailbox,
+			Criteria: QueryCriteria{
+				From:      internalQuery.Criteria.From,
+				To:        internalQuery.Criteria.To,
+				Subject:   internalQuery.Criteria.Subject,
+				Body:      internalQuery.Criteria.Body,
+				Text:      internalQuery.Criteria.Text,
+				SinceDays: internalQuery.Criteria.SinceDays,
+				Unseen:    internalQuery.Criteria.Unseen,
+				Seen:      internalQuery.Criteria.Seen,
+				Flagged:   internalQuery.Criteria.Flagged,
+				Larger:    internalQuery.Criteria.Larger,
+				Smaller:   internalQuery.Criteria.Smaller,
+			},
+		}
+		if query.Mailbox == "" {
+			query.Mailbox = "INBOX"
+		}
+		queries = append(queries, query)
+	}
+	return queries
+}
+
+// buildSearchCriteria translates a Query's JSON-friendly criteria into the
+// go-imap SearchCriteria used by imapMetrics.collect. Called fresh on every
+// scrape so that SinceDays stays relative to "now".
+func buildSearchCriteria(c QueryCriteria) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+
+	header := textproto.MIMEHeader{}
+	if c.From != "" {
+		header.Add("From", c.From)
+	}
+	if c.To != "" {
+		header.Add("To", c.To)
+	}
+	if c.Subject != "" {
+		header.Add("Subject", c.Subject)
+	}
+	if len(header) > 0 {
+		criteria.Header = header
+	}
+
+	if c.SinceDays > 0 {
+		criteria.SentSince = time.Now().AddDate(0, 0, -c.SinceDays)
+	}
+	if c.Unseen {
+		criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+	}
+	if c.Seen {
+		criteria.WithFlags = append(criteria.WithFlags, imap.SeenFlag)
+	}
+	if c.Flagged {
+		criteria.WithFlags = append(criteria.WithFlags, imap.FlaggedFlag)
+	}
+	if c.Body != "" {
+		criteria.Body = []string{c.Body}
+	}
+	if c.Text != "" {
+		criteria.Text = []string{c.Text}
+	}
+	criteria.Larger = c.Larger
+	criteria.Smaller = c.Smaller
+
+	return criteria
+}
+
+// parseAccountURL parses and validates an imap(s):// account or probe target
+// URL, defaulting the port from the scheme when none is given. imap+starttls
+// behaves like imap (plaintext port, TLS negotiated after connecting).
+func parseAccountURL(rawURL string) (*url.URL, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse URL %s: %s", rawURL, err)
+	}
+
+	if parsedURL.Scheme != "imap" && parsedURL.Scheme != "imaps" && parsedURL.Scheme != "imap+starttls" {
+		return nil, fmt.Errorf("unknown scheme: %s", parsedURL.Scheme)
+	}
+	if !strings.Contains(parsedURL.Host, ":") {
+		if parsedURL.Scheme == "imaps" {
+			parsedURL.Host += ":993"
+		} else {
+			parsedURL.Host += ":143"
+		}
+	}
+	if parsedURL.User == nil {
+		return nil, fmt.Errorf("no user/password in %s", rawURL)
+	}
+
+	if parsedURL.Opaque != "" || parsedURL.Path != "" || parsedURL.RawQuery != "" || parsedURL.Fragment != "" {
+		return nil, fmt.Errorf("wrong URL: %s", rawURL)
+	}
+
+	return parsedURL, nil
 }
 
 func NewConfig(filename string) Config {
@@ -65,43 +354,82 @@ func NewConfig(filename string) Config {
 			account.Filter = "*"
 		}
 
-		parsedURL, err := url.Parse(internalAccount.URL)
+		parsedURL, err := parseAccountURL(internalAccount.URL)
 		if err != nil {
-			log.Fatalf("Cannot parse URL %s: %s", account.URL, err)
+			log.Fatalln(err)
 		}
 
-		if parsedURL.Scheme != "imap" && parsedURL.Scheme != "imaps" {
-			log.Fatalf("Unknown scheme: %s", parsedURL.Scheme)
+		account.TLSConfig = buildTLSConfig(internalAccount.SkipTLSValidation, internalAccount.Pem)
+		account.URL = parsedURL
+		account.Idle = internalAccount.Idle
+
+		account.Auth, account.TokenCache = buildAuthConfig(
+			internalAccount.Auth, internalAccount.ClientID, internalAccount.ClientSecret,
+			internalAccount.RefreshToken, internalAccount.TokenURL, internalAccount.TokenSkewSeconds,
+			internalAccount.URL)
+
+		account.Queries = buildQueries(internalAccount.Queries)
+	}
+
+	if len(internalConfig.Modules) > 0 {
+		config.Modules = make(map[string]ModuleConfig, len(internalConfig.Modules))
+	}
+	for name, internalModule := range internalConfig.Modules {
+		module := ModuleConfig{
+			Filter:    internalModule.Filter,
+			Timeout:   time.Duration(internalModule.TimeoutSeconds * float64(time.Second)),
+			TLSConfig: buildTLSConfig(internalModule.SkipTLSValidation, internalModule.Pem),
 		}
-		if !strings.Contains(parsedURL.Host, ":") {
-			if parsedURL.Scheme == "imaps" {
-				parsedURL.Host += ":993"
-			} else {
-				parsedURL.Host += ":143"
-			}
+		if module.Filter == "" {
+			module.Filter = "*"
 		}
-		if parsedURL.User == nil {
-			log.Fatalln("No user/password")
+		if module.Timeout == 0 {
+			module.Timeout = config.Timeout
 		}
 
-		if parsedURL.Opaque != "" || parsedURL.Path != "" || parsedURL.RawQuery != "" || parsedURL.Fragment != "" {
-			log.Fatalf("Wrong URL: %s", account.URL)
+		module.Auth, module.TokenCache = buildAuthConfig(
+			internalModule.Auth, internalModule.ClientID, internalModule.ClientSecret,
+			internalModule.RefreshToken, internalModule.TokenURL, internalModule.TokenSkewSeconds,
+			name)
+		module.Queries = buildQueries(internalModule.Queries)
+
+		config.Modules[name] = module
+	}
+
+	for _, internalProbe := range internalConfig.Probes {
+		parsedURL, err := parseAccountURL(internalProbe.URL)
+		if err != nil {
+			log.Fatalln(err)
 		}
 
-		if internalAccount.SkipTLSValidation || internalAccount.Pem != "" {
-			account.TLSConfig = &tls.Config{}
-			if internalAccount.SkipTLSValidation {
-				account.TLSConfig.InsecureSkipVerify = true
-			} else if internalAccount.Pem != "" {
-				roots := x509.NewCertPool()
-				ok := roots.AppendCertsFromPEM([]byte(internalAccount.Pem))
-				if !ok {
-					log.Fatalf("failed to parse root certificate %s", internalAccount.Pem)
-				}
-				account.TLSConfig.RootCAs = roots
-			}
+		probe := RoundTripProbe{
+			Name: internalProbe.Name,
+			Account: Account{
+				Filter:    "*",
+				TLSConfig: buildTLSConfig(internalProbe.SkipTLSValidation, internalProbe.Pem),
+				URL:       parsedURL,
+			},
+			Mailbox:      internalProbe.Mailbox,
+			SMTPHost:     internalProbe.SMTPHost,
+			SMTPFrom:     internalProbe.SMTPFrom,
+			SMTPTo:       internalProbe.SMTPTo,
+			Deadline:     time.Duration(internalProbe.DeadlineSeconds * float64(time.Second)),
+			PollInterval: time.Duration(internalProbe.PollIntervalSeconds * float64(time.Second)),
+			Interval:     time.Duration(internalProbe.IntervalSeconds * float64(time.Second)),
 		}
-		account.URL = parsedURL
+		if probe.Mailbox == "" {
+			probe.Mailbox = "INBOX"
+		}
+		if probe.Deadline == 0 {
+			probe.Deadline = time.Minute
+		}
+		if probe.PollInterval == 0 {
+			probe.PollInterval = 5 * time.Second
+		}
+		if probe.Interval == 0 {
+			probe.Interval = 5 * time.Minute
+		}
+		config.Probes = append(config.Probes, probe)
 	}
 
 	return config
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	idle "github.com/emersion/go-imap-idle"
+	"github.com/emersion/go-imap/client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promDescConnectionUp = prometheus.NewDesc(
+		namespace+"_connection_up",
+		"1 if the persistent connection to the account is currently established.",
+		[]string{"server", "user"}, nil)
+	promReconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconnects_total",
+		Help:      "Number of times the persistent connection had to be re-established.",
+	}, []string{"server", "user"})
+	promIdleEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "idle_events_total",
+		Help:      "Number of unsolicited EXISTS/EXPUNGE/RECENT updates observed while IDLEing.",
+	}, []string{"server", "user", "mailbox"})
+)
+
+const (
+	noopInterval   = 30 * time.Second
+	maxBackoff     = time.Minute
+	initialBackoff = time.Second
+)
+
+// mailboxCache holds the last counts an IDLE watcher observed for one
+// mailbox, so Collector.Collect can read them instead of issuing STATUS.
+type mailboxCache struct {
+	mu       sync.Mutex
+	messages uint32
+	unseen   uint32
+	valid    bool
+}
+
+func (m *mailboxCache) set(messages, unseen uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = messages
+	m.unseen = unseen
+	m.valid = true
+}
+
+func (m *mailboxCache) get() (messages, unseen uint32, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.messages, m.unseen, m.valid
+}
+
+// connection is a per-account long-lived IMAP connection (mirroring
+// feed2imap-go's connConf/connection split): dialed once at startup, kept
+// alive with periodic NOOP, and reconnected with exponential backoff on
+// error. Accounts flagged Idle additionally get one dedicated watcher
+// connection per matching mailbox, feeding mailboxCache from unsolicited
+// EXISTS/EXPUNGE/RECENT updates.
+type connection struct {
+	account    Account
+	timeout    time.Duration
+	host, user string
+
+	cmdMu sync.Mutex // serializes command issuance on client
+
+	mu     sync.Mutex // guards client/up
+	client *client.Client
+	up     bool
+
+	idleMu        sync.Mutex
+	idleMailboxes map[string]*mailboxCache
+
+	// idleStart ensures startIdleWatchers (and its dedicated, independently
+	// long-lived watcher connections) is launched exactly once, regardless of
+	// how many times the shared connection itself reconnects.
+	idleStart sync.Once
+}
+
+func newConnection(account Account, timeout time.Duration, host, user string) *connection {
+	conn := &connection{account: account, timeout: timeout, host: host, user: user}
+	if account.Idle {
+		conn.idleMailboxes = make(map[string]*mailboxCache)
+	}
+	return conn
+}
+
+// run dials the account and keeps it alive forever, reconnecting on failure.
+// It is meant to be started once per account as its own goroutine.
+func (conn *connection) run() {
+	backoff := initialBackoff
+	established := false
+	for {
+		if err := conn.connect(); err != nil {
+			log.Printf("Could not connect to %s: %s", conn.host, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		if established {
+			promReconnectsTotal.WithLabelValues(conn.host, conn.user).Inc()
+		}
+		established = true
+		backoff = initialBackoff
+		conn.keepAlive()
+	}
+}
+
+func (conn *connection) connect() error {
+	c, err := dialAccount(conn.account, conn.timeout)
+	if err != nil {
+		return err
+	}
+
+	conn.mu.Lock()
+	conn.client = c
+	conn.up = true
+	conn.mu.Unlock()
+
+	if conn.account.Idle {
+		conn.idleStart.Do(func() { go conn.startIdleWatchers() })
+	}
+	return nil
+}
+
+// keepAlive NOOPs the connection until it errors, then marks it down so run()
+// redials with backoff.
+func (conn *connection) keepAlive() {
+	ticker := time.NewTicker(noopInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		conn.mu.Lock()
+		c := conn.client
+		conn.mu.Unlock()
+		if c == nil {
+			return
+		}
+
+		conn.cmdMu.Lock()
+		err := c.Noop()
+		conn.cmdMu.Unlock()
+		if err != nil {
+			conn.markDown()
+			return
+		}
+	}
+}
+
+func (conn *connection) markDown() {
+	conn.mu.Lock()
+	if conn.client != nil {
+		disconnectClient(conn.client)
+	}
+	conn.client = nil
+	conn.up = false
+	conn.mu.Unlock()
+}
+
+func (conn *connection) getClient() (*client.Client, bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.client, conn.up
+}
+
+func (conn *connection) isUp() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.up
+}
+
+func (conn *connection) cachedCount(mailbox string) (messages, unseen uint32, ok bool) {
+	conn.idleMu.Lock()
+	cache, exists := conn.idleMailboxes[mailbox]
+	conn.idleMu.Unlock()
+	if !exists {
+		return 0, 0, false
+	}
+	return cache.get()
+}
+
+// startIdleWatchers lists the account's matching mailboxes once and spawns a
+// dedicated IDLE watcher goroutine for each of them.
+func (conn *connection) startIdleWatchers() {
+	c, up := conn.getClient()
+	if !up {
+		return
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo)
+	done := make(chan error)
+	conn.cmdMu.Lock()
+	go func() {
+		done <- c.List("", conn.account.Filter, mailboxes)
+	}()
+	var names []string
+	for m := range mailboxes {
+		names = append(names, m.Name)
+	}
+	listErr := <-done
+	conn.cmdMu.Unlock()
+	if listErr != nil {
+		log.Printf("Could not list mailboxes to IDLE on %s: %s", conn.host, listErr)
+		return
+	}
+
+	for _, name := range names {
+		conn.idleMu.Lock()
+		_, exists := conn.idleMailboxes[name]
+		if !exists {
+			conn.idleMailboxes[name] = &mailboxCache{}
+		}
+		conn.idleMu.Unlock()
+		if !exists {
+			go conn.watchMailbox(name)
+		}
+	}
+}
+
+// watchMailbox keeps a dedicated connection IDLEing on one mailbox, updating
+// its mailboxCache with a STATUS refresh whenever an unsolicited server update
+// arrives. When the server does not support IDLE, IdleWithFallback
+// transparently falls back to polling the connection with NOOP instead of
+// returning, so this loop keeps running either way.
+func (conn *connection) watchMailbox(name string) {
+	backoff := initialBackoff
+	for {
+		if err := conn.idleOnce(name); err != nil {
+			log.Printf("IDLE on %s/%s failed: %s", conn.host, name, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = initialBackoff
+	}
+}
+
+// idleOnce selects name, seeds its cache from STATUS, then repeatedly IDLEs
+// until an unsolicited EXISTS/EXPUNGE update arrives. Each update breaks the
+// current IDLE session just long enough to re-issue STATUS (the only
+// response go-imap fills in an actual Unseen count for, as opposed to SELECT,
+// which leaves it at 0) before resuming IDLE.
+func (conn *connection) idleOnce(name string) error {
+	c, err := dialAccount(conn.account, conn.timeout)
+	if err != nil {
+		return err
+	}
+	defer disconnectClient(c)
+
+	if _, err := c.Select(name, false); err != nil {
+		return fmt.Errorf("cannot select %s: %s", name, err)
+	}
+
+	conn.idleMu.Lock()
+	cache := conn.idleMailboxes[name]
+	conn.idleMu.Unlock()
+
+	if err := refreshMailboxStatus(c, name, cache); err != nil {
+		return err
+	}
+
+	updates := make(chan client.Update, 8)
+	c.Updates = updates
+
+	for {
+		idleClient := idle.NewClient(c)
+		stop := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- idleClient.IdleWithFallback(stop, 0)
+		}()
+
+		select {
+		case update := <-updates:
+			close(stop)
+			if err := <-idleDone; err != nil {
+				return err
+			}
+			switch update.(type) {
+			case *client.MailboxUpdate, *client.ExpungeUpdate:
+				promIdleEventsTotal.WithLabelValues(conn.host, conn.user, name).Inc()
+			}
+			if err := refreshMailboxStatus(c, name, cache); err != nil {
+				return err
+			}
+		case err := <-idleDone:
+			return err
+		}
+	}
+}
+
+// refreshMailboxStatus issues a STATUS command for name and updates cache
+// with its message/unseen counts.
+func refreshMailboxStatus(c *client.Client, name string, cache *mailboxCache) error {
+	status, err := c.Status(name, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+	if err != nil {
+		return fmt.Errorf("cannot fetch status for %s: %s", name, err)
+	}
+	cache.set(uint32(status.Messages), uint32(status.Unseen))
+	return nil
+}
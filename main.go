@@ -25,5 +25,6 @@ func main() {
 
 	prometheus.MustRegister(&collector)
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/probe", probeHandler(&config))
 	log.Println(http.ListenAndServe(config.Listen, nil))
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probe_success and probe_duration_seconds are deliberately left outside the
+// imap_messages namespace: they follow the Prometheus blackbox exporter
+// convention so the same recording rules/dashboards work unmodified.
+var (
+	promDescProbeSuccess = prometheus.NewDesc(
+		"probe_success",
+		"Displays whether or not the probe was a success.",
+		nil, nil)
+	promDescProbeDurationSeconds = prometheus.NewDesc(
+		"probe_duration_seconds",
+		"Returns how long the probe took to complete in seconds.",
+		nil, nil)
+)
+
+// probeCollector runs a single, ephemeral imapMetrics collection and
+// additionally reports the blackbox-style probe_success/probe_duration_seconds
+// pair expected by Prometheus service discovery.
+type probeCollector struct {
+	metric *imapMetrics
+}
+
+func (p *probeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- promDescImapMessagesServerOkDesc
+	ch <- promDescImapMessagesTotalCount
+	ch <- promDescImapMessagesUnreadCount
+	ch <- promDescImapMessagesQueryCount
+	ch <- promDescProbeSuccess
+	ch <- promDescProbeDurationSeconds
+	ch <- promDescAuthTokenExpiry
+	promAuthRefreshTotal.Describe(ch)
+}
+
+func (p *probeCollector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	err := p.metric.collect(ch)
+	duration := time.Since(start).Seconds()
+
+	ch <- prometheus.MustNewConstMetric(promDescImapMessagesServerOkDesc, prometheus.GaugeValue,
+		errorToPromResult(err),
+		p.metric.host, p.metric.user)
+	ch <- prometheus.MustNewConstMetric(promDescProbeSuccess, prometheus.GaugeValue, errorToPromResult(err))
+	ch <- prometheus.MustNewConstMetric(promDescProbeDurationSeconds, prometheus.GaugeValue, duration)
+
+	if p.metric.account.TokenCache != nil {
+		ch <- prometheus.MustNewConstMetric(promDescAuthTokenExpiry, prometheus.GaugeValue,
+			p.metric.account.TokenCache.expirySeconds(),
+			p.metric.host, p.metric.user)
+	}
+	promAuthRefreshTotal.Collect(ch)
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// newProbeImapMetrics builds the imapMetrics for one /probe request, combining
+// the target URL (host/credentials) with the named module's settings (filter,
+// timeout, TLS options, auth mode, and queries).
+func newProbeImapMetrics(config *Config, target, moduleName string) (*imapMetrics, error) {
+	module, ok := config.Modules[moduleName]
+	if !ok {
+		return nil, fmt.Errorf("unknown module: %s", moduleName)
+	}
+
+	parsedURL, err := parseAccountURL(target)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse target %s: %s", target, err)
+	}
+
+	host, _, err := net.SplitHostPort(parsedURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not split host/port: %s", err)
+	}
+
+	timeout := module.Timeout
+	if timeout == 0 {
+		timeout = config.Timeout
+	}
+
+	dialer := newDialer(parsedURL.Scheme, parsedURL.Host, timeout, module.TLSConfig)
+
+	filter := module.Filter
+	if filter == "" {
+		filter = "*"
+	}
+
+	account := Account{
+		URL:        parsedURL,
+		TLSConfig:  module.TLSConfig,
+		Auth:       module.Auth,
+		TokenCache: module.TokenCache,
+	}
+
+	return &imapMetrics{
+		filter:  filter,
+		timeout: timeout,
+		dialer:  dialer,
+		account: account,
+		host:    host,
+		user:    parsedURL.User.Username(),
+		queries: module.Queries,
+	}, nil
+}
+
+// probeHandler serves /probe?target=...&module=..., mirroring the Prometheus
+// blackbox exporter so the IMAP exporter can be driven by service discovery
+// instead of the static accounts declared in the config file.
+func probeHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		moduleName := r.URL.Query().Get("module")
+		if moduleName == "" {
+			moduleName = "default"
+		}
+
+		metric, err := newProbeImapMetrics(config, target, moduleName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(&probeCollector{metric: metric})
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promRoundTripDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "probe_duration_seconds",
+		Help:      "Duration of the end-to-end SMTP send / IMAP receive round trip.",
+		Buckets:   []float64{1, 2, 5, 10, 15, 30, 60, 120, 300},
+	}, []string{"server", "user"})
+	promDescRoundTripSuccess = prometheus.NewDesc(
+		namespace+"_probe_success",
+		"1 if the probe message was observed in the mailbox before the deadline.",
+		[]string{"server", "user"}, nil)
+	promDescRoundTripLastDelivery = prometheus.NewDesc(
+		namespace+"_probe_last_delivery_timestamp_seconds",
+		"Unix timestamp of the last successful round-trip delivery.",
+		[]string{"server", "user"}, nil)
+	promRoundTripFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "probe_failures_total",
+		Help:      "Number of round-trip probe failures, by stage.",
+	}, []string{"server", "user", "stage"})
+)
+
+// roundTripMetrics drives one RoundTripProbe: send a tagged message over
+// SMTP, poll the mailbox until it shows up (or the deadline elapses), then
+// clean it up. The probe itself runs on its own ticker (run), independent of
+// any scrape; collect only ever publishes the cached result of the last run,
+// so a scrape never has to wait out a probe's deadline.
+type roundTripMetrics struct {
+	probe   RoundTripProbe
+	timeout time.Duration
+	host    string
+	user    string
+
+	mu     sync.Mutex
+	result roundTripResult
+}
+
+// roundTripResult is the cached outcome of the most recent probe run.
+type roundTripResult struct {
+	valid            bool
+	success          bool
+	duration         float64
+	lastDeliveryUnix float64
+	err              error
+}
+
+func newRoundTripMetrics(probe RoundTripProbe, timeout time.Duration) (*roundTripMetrics, error) {
+	host, _, err := net.SplitHostPort(probe.Account.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not split host/port: %s", err)
+	}
+	return &roundTripMetrics{
+		probe:   probe,
+		timeout: timeout,
+		host:    host,
+		user:    probe.Account.URL.User.Username(),
+	}, nil
+}
+
+func probeToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// run probes the account on the configured Interval, forever, caching each
+// result for collect to publish. It is meant to be started once per probe as
+// its own goroutine.
+func (r *roundTripMetrics) run() {
+	r.probeOnce()
+	ticker := time.NewTicker(r.probe.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.probeOnce()
+	}
+}
+
+// probeOnce sends and waits for a single tagged message, then caches the
+// outcome for collect.
+func (r *roundTripMetrics) probeOnce() {
+	result := roundTripResult{valid: true}
+
+	token, err := probeToken()
+	if err != nil {
+		result.err = fmt.Errorf("round-trip probe %s: cannot generate a token: %s", r.probe.Name, err)
+		r.setResult(result)
+		return
+	}
+	messageID := fmt.Sprintf("<%s@imap-exporter-probe>", token)
+
+	start := time.Now()
+	if err := r.submit(messageID); err != nil {
+		promRoundTripFailures.WithLabelValues(r.host, r.user, "submit").Inc()
+		result.err = fmt.Errorf("round-trip probe %s: submit failed: %s", r.probe.Name, err)
+		r.setResult(result)
+		return
+	}
+
+	c, uid, err := r.waitForDelivery(messageID)
+	result.duration = time.Since(start).Seconds()
+	if err != nil {
+		promRoundTripFailures.WithLabelValues(r.host, r.user, "appear").Inc()
+		result.err = fmt.Errorf("round-trip probe %s: message did not appear: %s", r.probe.Name, err)
+		r.setResult(result)
+		return
+	}
+
+	if err := deleteMessage(c, uid); err != nil {
+		promRoundTripFailures.WithLabelValues(r.host, r.user, "delete").Inc()
+	}
+	disconnectClient(c)
+
+	promRoundTripDuration.WithLabelValues(r.host, r.user).Observe(result.duration)
+	result.success = true
+	result.lastDeliveryUnix = float64(time.Now().Unix())
+	r.setResult(result)
+}
+
+func (r *roundTripMetrics) setResult(result roundTripResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Never let a failed run erase the last successful delivery timestamp.
+	if !result.success {
+		result.lastDeliveryUnix = r.result.lastDeliveryUnix
+	}
+	r.result = result
+}
+
+// collect publishes the cached result of the most recent probeOnce run; it
+// performs no network I/O of its own so a scrape never blocks on a probe.
+// The duration histogram itself is collected separately (it is a persistent
+// prometheus.HistogramVec, observed once per probe run in probeOnce, not
+// rebuilt here) so it accumulates across runs instead of resetting on every
+// scrape.
+func (r *roundTripMetrics) collect(ch chan<- prometheus.Metric) error {
+	r.mu.Lock()
+	result := r.result
+	r.mu.Unlock()
+
+	if !result.valid {
+		return nil
+	}
+
+	success := 0.0
+	if result.success {
+		success = 1
+	}
+	ch <- prometheus.MustNewConstMetric(promDescRoundTripSuccess, prometheus.GaugeValue, success, r.host, r.user)
+	ch <- prometheus.MustNewConstMetric(promDescRoundTripLastDelivery, prometheus.GaugeValue, result.lastDeliveryUnix, r.host, r.user)
+
+	return result.err
+}
+
+func (r *roundTripMetrics) submit(messageID string) error {
+	message := fmt.Sprintf("Message-Id: %s\r\nFrom: %s\r\nTo: %s\r\nSubject: imap-exporter round-trip probe\r\n\r\nimap-exporter round-trip probe.\r\n",
+		messageID, r.probe.SMTPFrom, r.probe.SMTPTo)
+	return smtp.SendMail(r.probe.SMTPHost, nil, r.probe.SMTPFrom, []string{r.probe.SMTPTo}, []byte(message))
+}
+
+// waitForDelivery returns the still-connected, logged-in client alongside the
+// UID of the delivered message, so the caller can delete it without a second
+// connection.
+func (r *roundTripMetrics) waitForDelivery(messageID string) (*client.Client, uint32, error) {
+	c, err := dialAccount(r.probe.Account, r.timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := c.Select(r.probe.Mailbox, false); err != nil {
+		disconnectClient(c)
+		return nil, 0, fmt.Errorf("cannot select %s: %s", r.probe.Mailbox, err)
+	}
+
+	deadline := time.Now().Add(r.probe.Deadline)
+	for {
+		uid, err := searchMessageID(c, messageID)
+		if err != nil {
+			disconnectClient(c)
+			return nil, 0, err
+		}
+		if uid != 0 {
+			return c, uid, nil
+		}
+		if time.Now().After(deadline) {
+			disconnectClient(c)
+			return nil, 0, fmt.Errorf("deadline exceeded waiting for %s", messageID)
+		}
+		time.Sleep(r.probe.PollInterval)
+	}
+}
+
+func searchMessageID(c *client.Client, messageID string) (uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header = textproto.MIMEHeader{"Message-Id": []string{messageID}}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return 0, fmt.Errorf("search failed: %s", err)
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	return uids[0], nil
+}
+
+func deleteMessage(c *client.Client, uid uint32) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	if err := c.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return fmt.Errorf("cannot flag message %d as deleted: %s", uid, err)
+	}
+	return c.Expunge(nil)
+}